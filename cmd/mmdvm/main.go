@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"strings"
 
+	dv "github.com/pd0mz/go-dv"
 	"github.com/pd0mz/go-dv/mmdvm"
 	"github.com/tarm/serial"
 )
@@ -14,27 +16,30 @@ func main() {
 	port := flag.String("port", "/dev/cu.usbmodem1411", "Modem port")
 	flag.Parse()
 
-	modem := mmdvm.New(&serial.Config{Name: *port})
-	if err := modem.Sync(); err != nil {
-		log.Fatalf("error syncing MMDVM modem on %s: %v", *port, err)
+	modem, err := mmdvm.NewSerial(&serial.Config{Name: *port})
+	if err != nil {
+		log.Fatalf("error creating MMDVM modem for %s: %v", *port, err)
 	}
 
-	go modem.Run()
+	ctx := context.Background()
+	go modem.Run(ctx)
 	defer modem.Close()
 
-	status, err := modem.Status()
+	<-modem.Ready()
+
+	status, err := modem.Status(ctx)
 	if err != nil {
 		log.Fatalf("error retrieving modem status: %v", err)
 	}
 	fmt.Printf("modes: %d (", status.Modes)
 	modes := []string{}
-	if status.Modes&mmdvm.ModeDStar > 0 {
+	if status.Modes&dv.ModeDStar > 0 {
 		modes = append(modes, "D-Star")
 	}
-	if status.Modes&mmdvm.ModeDMR > 0 {
+	if status.Modes&dv.ModeDMR > 0 {
 		modes = append(modes, "DMR")
 	}
-	if status.Modes&mmdvm.ModeSystemFusion > 0 {
+	if status.Modes&dv.ModeSystemFusion > 0 {
 		modes = append(modes, "System Fusion")
 	}
 	if len(modes) == 0 {
@@ -46,19 +51,14 @@ func main() {
 	switch status.State {
 	case mmdvm.StateIdle:
 		fmt.Println("idle)")
-		break
 	case mmdvm.StateDStar:
 		fmt.Println("d-star)")
-		break
 	case mmdvm.StateDMR:
 		fmt.Println("DMR)")
-		break
 	case mmdvm.StateSystemFusion:
 		fmt.Println("System Fusion)")
-		break
 	case mmdvm.StateCalibration:
 		fmt.Println("calibration)")
-		break
 	default:
 		fmt.Println("unknown)")
 	}
@@ -0,0 +1,25 @@
+package mmdvm
+
+// Metrics receives per-command counters from a Modem, so operators can
+// graph frames-per-second per mode and buffer-underrun/overflow rates.
+// Events currently emitted are "sent", "received", "ack", "nak", "timeout",
+// "decode_error" and "unhandled".
+type Metrics interface {
+	// Inc increments the counter for command and event, e.g.
+	// Inc(mmdvm.DMRData, "sent").
+	Inc(command uint8, event string)
+}
+
+// NopMetrics implements Metrics by discarding every increment. It is the
+// default for a Modem that hasn't been given a Metrics.
+type NopMetrics struct{}
+
+// Inc implements Metrics.
+func (NopMetrics) Inc(uint8, string) {}
+
+// Logger receives the diagnostic messages a Modem logs about unhandled
+// commands and unexpected frames. *log.Logger satisfies this interface, so
+// the standard library logger can be used as-is.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
@@ -2,12 +2,15 @@
 package mmdvm
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"sync"
 	"time"
 
+	dv "github.com/pd0mz/go-dv"
 	"github.com/tarm/serial"
 )
 
@@ -81,9 +84,6 @@ var (
 	}
 )
 
-// The package logger
-var logger = *log.Logger
-
 // States
 const (
 	StateIdle uint8 = iota
@@ -131,147 +131,249 @@ type Status struct {
 	SystemFusionBufferSize uint8
 }
 
+// Modem talks the MMDVM protocol to a Multi-Mode Digital Voice Modem over a
+// pluggable Transport.
 type Modem struct {
-	Config   *serial.Config
 	Timeout  time.Duration
-	Callback map[uint8]modem.ModemDataFunc
-
-	port     *serial.Port
-	callback map[uint8]chan []byte
-	running  bool
-	version  int
+	Callback map[uint8]dv.ModemDataFunc
+
+	// Logger receives diagnostics about unhandled commands and unexpected
+	// frames. Defaults to a *log.Logger writing to stderr.
+	Logger Logger
+	// Metrics receives per-command counters. Defaults to NopMetrics.
+	Metrics Metrics
+	// StatusPollInterval is how often Run polls GetStatus to refresh the TX
+	// buffer space model used by the Enqueue* methods.
+	StatusPollInterval time.Duration
+
+	transport  Transport
+	callback   map[uint8]chan []byte
+	callbackMu sync.Mutex
+	cancelMu   sync.Mutex
+	cancel     context.CancelFunc
+	ready      chan struct{}
+	version    int
+	modes      uint8
+	lastState  uint8
+
+	txMu      sync.Mutex
+	txFree    map[bufferKind]int
+	txQueue   map[bufferKind]chan *txFrame
+	txPending sync.WaitGroup
 }
 
-func New(config *serial.Config) (*Modem, error) {
-	var err error
+var _ dv.Modem = (*Modem)(nil)
 
+// New creates a Modem that talks to the MMDVM firmware over the given
+// Transport.
+func New(transport Transport) (*Modem, error) {
 	m := &Modem{
-		Config:   config,
-		Callback: make(map[uint8]modem.ModemDataFunc),
-		Timeout:  DefaultTimeout,
-		callback: make(map[uint8]chan []byte),
+		Callback:           make(map[uint8]dv.ModemDataFunc),
+		Timeout:            DefaultTimeout,
+		Logger:             log.New(os.Stderr, "mmdvm: ", log.LstdFlags),
+		Metrics:            NopMetrics{},
+		StatusPollInterval: DefaultStatusPollInterval,
+		transport:          transport,
+		callback:           make(map[uint8]chan []byte),
+		ready:              make(chan struct{}),
+		txFree: map[bufferKind]int{
+			bufferDStar:        bufferSpaceUnknown,
+			bufferDMRTS1:       bufferSpaceUnknown,
+			bufferDMRTS2:       bufferSpaceUnknown,
+			bufferSystemFusion: bufferSpaceUnknown,
+		},
+		txQueue: map[bufferKind]chan *txFrame{
+			bufferDStar:        make(chan *txFrame),
+			bufferDMRTS1:       make(chan *txFrame),
+			bufferDMRTS2:       make(chan *txFrame),
+			bufferSystemFusion: make(chan *txFrame),
+		},
 	}
-	m.Config.Baud = Baud
-
 	return m, nil
 }
 
-func (m *Modem) Run() error {
-	var (
-		err  error
-		data []byte
-	)
-
-	// Open the serial port
-	logger.Printf("opening serial port %s at %d baud\n", m.Config.Name, m.Config.Baud)
-	if m.port, err = serial.OpenPort(m.Config); err != nil {
-		return err
-	}
-
-	// First we have to sync the modem, so we'll keep reading until we get an answer for our Get Version inquiry
-	if _, err = m.port.Write([]byte{FrameStart, 0x03, GetVersion}); err != nil {
-		return err
+// NewSerial is a thin helper that opens the serial port described by config
+// and returns a Modem that talks to it, equivalent to
+// New(NewSerialTransport(config)).
+func NewSerial(config *serial.Config) (*Modem, error) {
+	transport, err := NewSerialTransport(config)
+	if err != nil {
+		return nil, err
 	}
+	return New(transport)
+}
 
-	// Create a small buffer that fits the frame start, size and response byte
-	data = make([]byte, 3)
-	if _, err = m.port.Read(data); err != nil {
+// Run synchronises with the modem over its Transport and then services
+// incoming frames until ctx is cancelled, an unrecoverable I/O error
+// occurs, or the modem sends an ACK or NAK frame too short to carry the
+// command it answers. Cancelling ctx unblocks Run but does not close the underlying
+// Transport; call Close for that. Run relies on the Transport to honour
+// ctx for any in-flight read or write: NetTransport does so by racing
+// against ctx.Done(), while SerialTransport can only check ctx between
+// frames, since github.com/tarm/serial exposes no way to interrupt a
+// blocking read.
+func (m *Modem) Run(ctx context.Context) error {
+	var frame []byte
+
+	ctx, cancel := context.WithCancel(ctx)
+	m.cancelMu.Lock()
+	m.cancel = cancel
+	m.cancelMu.Unlock()
+	defer cancel()
+
+	// Callers that background Run (e.g. cmd/mmdvm) need to know once sync
+	// has happened before issuing their own commands; close m.ready once,
+	// whether sync succeeds or Run bails out early, so a waiter is never
+	// left blocked forever.
+	var readyOnce sync.Once
+	markReady := func() { readyOnce.Do(func() { close(m.ready) }) }
+	defer markReady()
+
+	// First we have to sync the modem, so we'll keep reading frames until we
+	// get an answer for our Get Version inquiry
+	m.Logger.Printf("synchronising with modem")
+	if err := m.transport.WriteFrame(ctx, []byte{GetVersion}); err != nil {
 		return err
 	}
 
-	// Keep reading the next byte until we have an answer
-	for data[0] != FrameStart && data[2] != GetVersion {
-		// Shift our buffer and append a null byte, which we'll fill with data from the serial link
-		data = append(data[1:], []byte{0x00}...)
-		if _, err = m.port.Read(data[2:]); err != nil {
+	var err error
+	for {
+		if frame, err = m.transport.ReadFrame(ctx); err != nil {
 			return err
 		}
+		if frame[0] == GetVersion {
+			break
+		}
 	}
 
 	// We are in a Get Version frame, check the received length
-	if data[1] < 4 {
+	if len(frame) < 2 {
 		return errors.New("mmdvm: synchronisation error")
 	}
 
-	// Receive the rest of the version information frame
-	data = make([]byte, data[1]-3)
-	if _, err = m.port.Read(data); err != nil {
-		return err
-	}
-
-	m.version = int(data[0])
+	m.version = int(frame[1])
 	if m.version != 0x01 {
 		return fmt.Errorf("mmdvm: unsupported protocol version %d", m.version)
 	}
 
-	// Start receive loop
-	m.running = true
-	for m.running {
-		// Read frame start and size byte
-		data = make([]byte, 2)
-		if _, err = m.port.Read(data); err != nil {
-			return err
-		}
+	markReady()
 
-		if data[0] != FrameStart {
-			return m.errUnexpected(data[0], FrameStart)
-		}
-		if data[1] < 2 {
-			return fmt.Errorf("mmdvm: received invalid packet length %d", data[1])
+	// Start the per-buffer TX queues and the background status poller that
+	// feeds their buffer-space model; both stop when ctx is done
+	for buf, queue := range m.txQueue {
+		go m.runTXQueue(ctx, buf, queue)
+	}
+	go m.pollStatus(ctx)
+
+	// Start receive loop, bailing out as soon as ctx is cancelled
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
 		}
 
-		// Extend the receive buffer with the specified length
-		data = append(data, make([]byte, data[1]-2)...)
-		if _, err = m.Port.Read(data[2:]); err != nil {
+		if frame, err = m.transport.ReadFrame(ctx); err != nil {
 			return err
 		}
 
-		switch data[2] {
+		switch frame[0] {
 		case ACK, NAK:
 			// For ACK/NAK, the actual response type is in the next byte
-			if len(data) < 4 {
-				return fmt.Errorf("mmdvm: received invalid %s packet length %d", CommandName[data[2]], data[1])
+			if len(frame) < 2 {
+				m.Metrics.Inc(frame[0], "decode_error")
+				return fmt.Errorf("mmdvm: received invalid %s frame", CommandName[frame[0]])
+			}
+			if frame[0] == ACK {
+				m.Metrics.Inc(frame[1], "ack")
+			} else {
+				m.Metrics.Inc(frame[1], "nak")
 			}
 
 			// Check if there is a callback registered
-			c, ok := m.callback[data[3]]
+			c, ok := m.lookupCallback(frame[1])
 			if !ok {
 				// No callback registered, log an error
-				logger.Printf("received %s for unhandled command %#02x (%s)", CommandName[data[2]], data[3], CommandName[data[3]])
+				m.Metrics.Inc(frame[1], "unhandled")
+				m.Logger.Printf("received %s for unhandled command %#02x (%s), last-seen state %#02x", CommandName[frame[0]], frame[1], CommandName[frame[1]], m.lastState)
 				continue
 			}
-			c <- data
-			break
+			c <- frame
 
 		case DStarHeader, DStarData, DMRData, SystemFusionData:
+			m.Metrics.Inc(frame[0], "received")
+
 			// For these packets, we use callback functions
-			if m.Callback[data[2]] == nil {
-				logger.Printf("received %s but we have no callback registered (ignored)", CommandName[data[2]])
+			f, ok := m.Callback[frame[0]]
+			if !ok || f == nil {
+				m.Metrics.Inc(frame[0], "unhandled")
+				m.Logger.Printf("received %s but we have no callback registered (ignored), last-seen state %#02x", CommandName[frame[0]], m.lastState)
 				continue
 			}
-
-			if err = m.Callback[data[2]](m, data); err != nil {
-				return err
-			}
-			break
+			f(m, frame)
 
 		default:
-			if len(data) < 3 {
-				return fmt.Errorf("mmdvm: received invalid packet length %d", data[1])
-			}
-
 			// Check if there is a callback registered
-			c, ok := m.callback[data[2]]
+			c, ok := m.lookupCallback(frame[0])
 			if !ok {
-				logger.Printf("received unhandled response %#02x (%s)", data[2], CommandName[data[2]])
+				m.Metrics.Inc(frame[0], "unhandled")
+				m.Logger.Printf("received unhandled response %#02x (%s), last-seen state %#02x", frame[0], CommandName[frame[0]], m.lastState)
 				continue
 			}
-			c <- data
-			break
+			c <- frame
 		}
 	}
+}
 
-	return nil
+// Close stops the receive loop started by Run and closes the underlying Transport.
+func (m *Modem) Close() error {
+	m.cancelMu.Lock()
+	cancel := m.cancel
+	m.cancelMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	return m.transport.Close()
+}
+
+// Ready returns a channel that's closed once Run has finished synchronising
+// with the modem (or given up trying to). Callers that background Run, as
+// cmd/mmdvm does, should wait on Ready before issuing Send/Enqueue calls so
+// they don't race Run's own Get Version handshake.
+func (m *Modem) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// registerCallback allocates the response channel for command, guarding
+// m.callback against the concurrent readers in Run and the concurrent
+// writers in sendAndWait (one per buffer's TX queue goroutine).
+func (m *Modem) registerCallback(command uint8) chan []byte {
+	m.callbackMu.Lock()
+	defer m.callbackMu.Unlock()
+
+	ch := make(chan []byte, 1)
+	m.callback[command] = ch
+	return ch
+}
+
+// unregisterCallback removes command's response channel once sendAndWait is
+// done with it.
+func (m *Modem) unregisterCallback(command uint8) {
+	m.callbackMu.Lock()
+	defer m.callbackMu.Unlock()
+
+	delete(m.callback, command)
+}
+
+// lookupCallback returns the response channel registered for command, if
+// any, guarding m.callback the same way registerCallback does.
+func (m *Modem) lookupCallback(command uint8) (chan []byte, bool) {
+	m.callbackMu.Lock()
+	defer m.callbackMu.Unlock()
+
+	c, ok := m.callback[command]
+	return c, ok
 }
 
 func (m *Modem) errUnexpected(got, want uint8) error {
@@ -281,15 +383,18 @@ func (m *Modem) errUnexpected(got, want uint8) error {
 	return fmt.Errorf("mmdvm: unexpected response, got %#02x, wanted %#02x", got, want)
 }
 
-func (m *Modem) send(body []byte) error {
-	var size = uint8(len(body) + 2)
-	var head = []byte{FrameStart, size}
-	var frame = append(head, body...)
-	_, err := m.port.Write(frame)
-	return err
+func (m *Modem) send(ctx context.Context, body []byte) error {
+	if err := m.transport.WriteFrame(ctx, body); err != nil {
+		return err
+	}
+	m.Metrics.Inc(body[0], "sent")
+	return nil
 }
 
-func (m *Modem) sendAndWait(body []byte, t time.Duration) ([]byte, error) {
+// sendAndWait writes body to the modem and waits for the matching response,
+// honouring ctx's deadline and cancellation. If ctx carries no deadline, m.Timeout
+// is applied as a default so callers aren't required to set one up themselves.
+func (m *Modem) sendAndWait(ctx context.Context, body []byte) ([]byte, error) {
 	var command uint8
 
 	switch body[0] {
@@ -299,76 +404,84 @@ func (m *Modem) sendAndWait(body []byte, t time.Duration) ([]byte, error) {
 		command = body[0]
 	}
 
+	if _, ok := ctx.Deadline(); !ok && m.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.Timeout)
+		defer cancel()
+	}
+
 	// Create our on-off receive channel ...
-	m.callback[command] = make(chan []byte, 1)
+	ch := m.registerCallback(command)
 	// ... and clean it up after this function is done
-	defer func() {
-		delete(m.callback, command)
-	}()
+	defer m.unregisterCallback(command)
 
-	if err := m.send(body); err != nil {
+	if err := m.send(ctx, body); err != nil {
 		return nil, err
 	}
 
-	// Return once there is data on the channel or if there is a timeout
+	// Return once there is data on the channel, or unblock with ctx's error
+	// when it's done (timeout or caller cancellation)
 	select {
-	case data := <-m.callback[command]:
+	case data := <-ch:
 		return data, nil
-	case <-time.After(t):
-		break
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			m.Metrics.Inc(command, "timeout")
+			return nil, ErrTimeout
+		}
+		return nil, ctx.Err()
 	}
-	return nil, ErrTimeout
 }
 
-func (m *Modem) sendAndWaitForACK(body []byte, t time.Duration) error {
-	data, err := m.sendAndWait(body, t)
+func (m *Modem) sendAndWaitForACK(ctx context.Context, body []byte) error {
+	frame, err := m.sendAndWait(ctx, body)
 	if err != nil {
 		return err
 	}
 
-	switch data[2] {
+	switch frame[0] {
 	case ACK:
 		return nil
 
 	case NAK:
-		if err, ok := nakError[data[4]]; ok {
+		if err, ok := nakError[frame[2]]; ok {
 			return err
 		}
-		return fmt.Errorf("mmdvm: received NAK for unknown reason %#02x", data[4])
+		return fmt.Errorf("mmdvm: received NAK for unknown reason %#02x", frame[2])
 
 	default:
-		return m.errUnexpected(got, ACK)
+		return m.errUnexpected(frame[0], ACK)
 	}
 }
 
 // SendDStarHeader sends a D-Star header, if there is an error it will be returned immediately, if the header was received correctly, no feedback will be provided
-func (m *Modem) SendDStarHeader(head []byte, timeout time.Duration) error {
-	return m.sendAndWaitForACK(append([]byte{DStarHeader}, head...), t)
+func (m *Modem) SendDStarHeader(ctx context.Context, head []byte) error {
+	return m.sendAndWaitForACK(ctx, append([]byte{DStarHeader}, head...))
 }
 
 // SendDStarData sends D-Star data, if there is an error it will be returned immediately, if the data was received correctly, no feedback will be provided
-func (m *Modem) SendDStarData(data []byte, timeout time.Duration) error {
-	return m.sendAndWaitForACK(append([]byte{DStarData}, data...), t)
+func (m *Modem) SendDStarData(ctx context.Context, data []byte) error {
+	return m.sendAndWaitForACK(ctx, append([]byte{DStarData}, data...))
 }
 
 // SendDStarEOT sends a D-Star End Of Transmission, if there is an error it will be returned immediately, if the data was received correctly, no feedback will be provided
-func (m *Modem) SendDStarEOT(timeout time.Duration) error {
-	return m.sendAndWaitForACK(append([]byte{DStarEOT}, data...), t)
+func (m *Modem) SendDStarEOT(ctx context.Context) error {
+	return m.sendAndWaitForACK(ctx, []byte{DStarEOT})
 }
 
 // SendDMRData sends DMR data, if there is an error it will be returned immediately, if the data was received correctly, no feedback will be provided
-func (m *Modem) SendDMRData(data []byte, timeout time.Duration) error {
-	return m.sendAndWaitForACK(append([]byte{DMRData}, data...), t)
+func (m *Modem) SendDMRData(ctx context.Context, data []byte) error {
+	return m.sendAndWaitForACK(ctx, append([]byte{DMRData}, data...))
 }
 
 // SendSystemFusionData sends System Fusion data, if there is an error it will be returned immediately, if the data was received correctly, no feedback will be provided
-func (m *Modem) SendSystemFusionData(data []byte, timeout time.Duration) error {
-	return m.sendAndWaitForACK(append([]byte{SystemFusionData}, data...), t)
+func (m *Modem) SendSystemFusionData(ctx context.Context, data []byte) error {
+	return m.sendAndWaitForACK(ctx, append([]byte{SystemFusionData}, data...))
 }
 
 // SetConfig is used to inform the modem about parameters relevant to its operation
-func (m *Modem) SetConfig(c Config) error {
-	return m.sendAndWaitForACK([]byte{
+func (m *Modem) SetConfig(ctx context.Context, c Config) error {
+	return m.sendAndWaitForACK(ctx, []byte{
 		SetConfig,
 		c.Inversion,
 		c.Modes,
@@ -377,36 +490,40 @@ func (m *Modem) SetConfig(c Config) error {
 		c.RXInputLevel,
 		c.TXInputLevel,
 		c.DMRColorCode,
-	}, m.Timeout)
+	})
 }
 
 // SetMode sets the supported modes
-func (m *Modem) SetMode(mode uint8) error {
-	return m.sendAndWaitForACK([]byte{
+func (m *Modem) SetMode(ctx context.Context, mode uint8) error {
+	return m.sendAndWaitForACK(ctx, []byte{
 		SetMode,
 		mode,
-	}, m.Timeout)
+	})
 }
 
 // Status is used to determine the current parameters of the modem
-func (m *Modem) Status() (*Status, error) {
-	data, err := m.sendAndWait([]byte{GetStatus}, m.Timeout)
+func (m *Modem) Status(ctx context.Context) (*Status, error) {
+	frame, err := m.sendAndWait(ctx, []byte{GetStatus})
 	if err != nil {
 		return nil, err
 	}
-	if len(data) != 10 {
-		return nil, fmt.Errorf("mmdvm: expected 10 status bytes, got %d", len(data))
+	if len(frame) != 8 {
+		return nil, fmt.Errorf("mmdvm: expected 8 status bytes, got %d", len(frame))
 	}
-
-	return &Status{
-		Modes:                  data[3],
-		State:                  data[4],
-		Flags:                  data[5],
-		DStarBufferSize:        data[6],
-		DMRTS1BufferSize:       data[7],
-		DMRTS2BufferSize:       data[8],
-		SystemFusionBufferSize: data[9],
-	}, nil
+	m.modes = frame[1]
+	m.lastState = frame[2]
+
+	status := &Status{
+		Modes:                  frame[1],
+		State:                  frame[2],
+		Flags:                  frame[3],
+		DStarBufferSize:        frame[4],
+		DMRTS1BufferSize:       frame[5],
+		DMRTS2BufferSize:       frame[6],
+		SystemFusionBufferSize: frame[7],
+	}
+	m.updateBufferSpace(status)
+	return status, nil
 }
 
 // Version returns the modem version
@@ -414,22 +531,28 @@ func (m *Modem) Version() int {
 	return m.version
 }
 
-func (m *Modem) SetDStarHeaderFunc(f ModemDataFunc) {
+// Modes reports what modi are supported by the modem, as last reported by
+// GetStatus. It satisfies dv.Modem.
+func (m *Modem) Modes() uint8 {
+	return m.modes
+}
+
+func (m *Modem) SetDStarHeaderFunc(f dv.ModemDataFunc) error {
 	m.Callback[DStarHeader] = f
+	return nil
 }
 
-func (m *Modem) SetDStarDataFunc(f ModemDataFunc) {
+func (m *Modem) SetDStarDataFunc(f dv.ModemDataFunc) error {
 	m.Callback[DStarData] = f
+	return nil
 }
 
-func (m *Modem) SetDMRDataFunc(f ModemDataFunc) {
+func (m *Modem) SetDMRDataFunc(f dv.ModemDataFunc) error {
 	m.Callback[DMRData] = f
+	return nil
 }
 
-func (m *Modem) SetSystemFusionDataFunc(f ModemDataFunc) {
+func (m *Modem) SetSystemFusionDataFunc(f dv.ModemDataFunc) error {
 	m.Callback[SystemFusionData] = f
-}
-
-func init() {
-	logger = log.New(os.Stderr, "mmdvm: ", log.LstdFlags)
+	return nil
 }
@@ -0,0 +1,94 @@
+package mmdvm_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dv "github.com/pd0mz/go-dv"
+	"github.com/pd0mz/go-dv/mmdvm"
+	"github.com/pd0mz/go-dv/mmdvm/mmdvmtest"
+)
+
+func newTestModem(t *testing.T) (context.Context, *mmdvm.Modem, *mmdvmtest.Emulator) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	emu, transport := mmdvmtest.NewPipe()
+	emu.Status = mmdvm.Status{
+		Modes:                  dv.ModeDMR,
+		State:                  mmdvm.StateIdle,
+		DStarBufferSize:        32,
+		DMRTS1BufferSize:       32,
+		DMRTS2BufferSize:       32,
+		SystemFusionBufferSize: 32,
+	}
+
+	modem, err := mmdvm.New(transport)
+	if err != nil {
+		t.Fatalf("mmdvm.New: %v", err)
+	}
+
+	go emu.Serve(ctx)
+	runErr := make(chan error, 1)
+	go func() { runErr <- modem.Run(ctx) }()
+	t.Cleanup(func() {
+		modem.Close()
+		<-runErr
+	})
+
+	select {
+	case <-modem.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for modem to sync")
+	}
+
+	return ctx, modem, emu
+}
+
+func TestModemStatusOverEmulator(t *testing.T) {
+	ctx, modem, emu := newTestModem(t)
+
+	status, err := modem.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.Modes != emu.Status.Modes {
+		t.Errorf("Modes = %#02x, want %#02x", status.Modes, emu.Status.Modes)
+	}
+	if status.DMRTS1BufferSize != emu.Status.DMRTS1BufferSize {
+		t.Errorf("DMRTS1BufferSize = %d, want %d", status.DMRTS1BufferSize, emu.Status.DMRTS1BufferSize)
+	}
+}
+
+func TestModemSendDMRData(t *testing.T) {
+	ctx, modem, _ := newTestModem(t)
+
+	if err := modem.SendDMRData(ctx, []byte{0x01, 0x02, 0x03}); err != nil {
+		t.Fatalf("SendDMRData: %v", err)
+	}
+}
+
+func TestModemReceivesInjectedDMRData(t *testing.T) {
+	ctx, modem, emu := newTestModem(t)
+
+	received := make(chan []byte, 1)
+	modem.SetDMRDataFunc(func(_ dv.Modem, data []byte) {
+		received <- data
+	})
+
+	if err := emu.InjectDMRData(ctx, []byte{0x0a, 0x0b}); err != nil {
+		t.Fatalf("InjectDMRData: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		if data[0] != mmdvm.DMRData {
+			t.Errorf("callback frame command = %#02x, want %#02x", data[0], mmdvm.DMRData)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for DMR data callback")
+	}
+}
@@ -0,0 +1,35 @@
+// Package mmdvmprom adapts mmdvm.Metrics to Prometheus.
+package mmdvmprom
+
+import (
+	"fmt"
+
+	"github.com/pd0mz/go-dv/mmdvm"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements mmdvm.Metrics on top of a single Prometheus CounterVec,
+// labelled by command (its two-digit hex value) and event.
+type Metrics struct {
+	frames *prometheus.CounterVec
+}
+
+var _ mmdvm.Metrics = (*Metrics)(nil)
+
+// New creates a Metrics and registers it with reg.
+func New(reg prometheus.Registerer) (*Metrics, error) {
+	frames := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mmdvm",
+		Name:      "frames_total",
+		Help:      "Number of MMDVM frames processed, by command and event.",
+	}, []string{"command", "event"})
+	if err := reg.Register(frames); err != nil {
+		return nil, err
+	}
+	return &Metrics{frames: frames}, nil
+}
+
+// Inc implements mmdvm.Metrics.
+func (m *Metrics) Inc(command uint8, event string) {
+	m.frames.WithLabelValues(fmt.Sprintf("%#02x", command), event).Inc()
+}
@@ -0,0 +1,129 @@
+// Package mmdvmtest implements the modem side of the MMDVM protocol, so
+// that tests can exercise an mmdvm.Modem against a fake modem instead of
+// real hardware on a serial port.
+package mmdvmtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/pd0mz/go-dv/mmdvm"
+)
+
+// Emulator answers GetVersion, GetStatus, SetConfig, SetMode and the
+// D-Star/DMR/System Fusion send commands the way a real MMDVM modem would,
+// over any mmdvm.Transport. Status and Version can be changed between
+// calls to Serve to simulate the modem's state changing over time.
+type Emulator struct {
+	// Version is reported in response to GetVersion.
+	Version uint8
+	// Status is reported in response to GetStatus.
+	Status mmdvm.Status
+
+	// NAKReason, when set for a command, makes the emulator NAK that
+	// command with the given reason instead of ACKing it. It has no
+	// effect on GetVersion or GetStatus, which never NAK.
+	NAKReason map[uint8]uint8
+
+	transport mmdvm.Transport
+}
+
+// New returns an Emulator that serves requests over transport.
+func New(transport mmdvm.Transport) *Emulator {
+	return &Emulator{
+		Version:   0x01,
+		NAKReason: make(map[uint8]uint8),
+		transport: transport,
+	}
+}
+
+// NewPipe returns an Emulator wired up to an in-memory client Transport via
+// net.Pipe, so a test can drive an mmdvm.Modem without any hardware or OS
+// serial device:
+//
+//	emu, transport := mmdvmtest.NewPipe()
+//	modem, _ := mmdvm.New(transport)
+//	go emu.Serve(ctx)
+//	go modem.Run(ctx)
+func NewPipe() (*Emulator, mmdvm.Transport) {
+	client, server := net.Pipe()
+	return New(mmdvm.NewNetTransport(server)), mmdvm.NewNetTransport(client)
+}
+
+// Serve answers requests until ctx is done, the transport returns an
+// error (which happens when it is closed), or a command arrives that the
+// emulator does not handle, in which case Serve returns an error naming it.
+func (e *Emulator) Serve(ctx context.Context) error {
+	for {
+		frame, err := e.transport.ReadFrame(ctx)
+		if err != nil {
+			return err
+		}
+		if err := e.handle(ctx, frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *Emulator) handle(ctx context.Context, frame []byte) error {
+	command := frame[0]
+	switch command {
+	case mmdvm.GetVersion:
+		return e.transport.WriteFrame(ctx, []byte{mmdvm.GetVersion, e.Version})
+
+	case mmdvm.GetStatus:
+		s := e.Status
+		return e.transport.WriteFrame(ctx, []byte{
+			mmdvm.GetStatus,
+			s.Modes,
+			s.State,
+			s.Flags,
+			s.DStarBufferSize,
+			s.DMRTS1BufferSize,
+			s.DMRTS2BufferSize,
+			s.SystemFusionBufferSize,
+		})
+
+	case mmdvm.SetConfig, mmdvm.SetMode,
+		mmdvm.DStarHeader, mmdvm.DStarData, mmdvm.DStarEOT,
+		mmdvm.DMRData, mmdvm.SystemFusionData:
+		return e.acknowledge(ctx, command)
+
+	default:
+		return fmt.Errorf("mmdvmtest: unhandled command %#02x", command)
+	}
+}
+
+// acknowledge ACKs command, or NAKs it with the reason set in e.NAKReason.
+func (e *Emulator) acknowledge(ctx context.Context, command uint8) error {
+	if reason, ok := e.NAKReason[command]; ok {
+		return e.transport.WriteFrame(ctx, []byte{mmdvm.NAK, command, reason})
+	}
+	return e.transport.WriteFrame(ctx, []byte{mmdvm.ACK, command})
+}
+
+// InjectDStarHeader delivers a D-Star header to the client as if it had
+// been received over the air, exercising its DStarHeaderFunc callback.
+func (e *Emulator) InjectDStarHeader(ctx context.Context, head []byte) error {
+	return e.transport.WriteFrame(ctx, append([]byte{mmdvm.DStarHeader}, head...))
+}
+
+// InjectDStarData delivers D-Star data to the client as if it had been
+// received over the air, exercising its DStarDataFunc callback.
+func (e *Emulator) InjectDStarData(ctx context.Context, data []byte) error {
+	return e.transport.WriteFrame(ctx, append([]byte{mmdvm.DStarData}, data...))
+}
+
+// InjectDMRData delivers DMR data to the client as if it had been received
+// over the air, exercising its DMRDataFunc callback.
+func (e *Emulator) InjectDMRData(ctx context.Context, data []byte) error {
+	return e.transport.WriteFrame(ctx, append([]byte{mmdvm.DMRData}, data...))
+}
+
+// InjectSystemFusionData delivers System Fusion data to the client as if it
+// had been received over the air, exercising its SystemFusionDataFunc
+// callback.
+func (e *Emulator) InjectSystemFusionData(ctx context.Context, data []byte) error {
+	return e.transport.WriteFrame(ctx, append([]byte{mmdvm.SystemFusionData}, data...))
+}
@@ -0,0 +1,184 @@
+package mmdvm
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+// Transport carries framed MMDVM packets between this package and the
+// modem, independent of the underlying link. A frame, as read from or
+// written to a Transport, is the command byte followed by its payload;
+// the FrameStart marker and length byte that appear on the wire are a
+// Transport implementation detail and never seen by callers.
+type Transport interface {
+	// ReadFrame blocks until a complete frame has arrived, ctx is done, or
+	// an unrecoverable I/O error occurs.
+	ReadFrame(ctx context.Context) ([]byte, error)
+
+	// WriteFrame writes a single frame, honouring ctx's deadline where the
+	// underlying link supports one.
+	WriteFrame(ctx context.Context, frame []byte) error
+
+	// Close releases the underlying link.
+	Close() error
+}
+
+// SerialTransport speaks the MMDVM framing over a github.com/tarm/serial port.
+type SerialTransport struct {
+	port *serial.Port
+}
+
+// NewSerialTransport opens the serial port described by config and returns a
+// Transport that speaks the MMDVM framing over it. The port's baud rate is
+// forced to Baud, as required by the MMDVM firmware.
+func NewSerialTransport(config *serial.Config) (*SerialTransport, error) {
+	config.Baud = Baud
+	port, err := serial.OpenPort(config)
+	if err != nil {
+		return nil, err
+	}
+	return &SerialTransport{port: port}, nil
+}
+
+// ReadFrame implements Transport.
+func (t *SerialTransport) ReadFrame(ctx context.Context) ([]byte, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	return readFrame(t.port)
+}
+
+// WriteFrame implements Transport.
+func (t *SerialTransport) WriteFrame(ctx context.Context, frame []byte) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	_, err := t.port.Write(encodeFrame(frame))
+	return err
+}
+
+// Close implements Transport.
+func (t *SerialTransport) Close() error {
+	return t.port.Close()
+}
+
+// NetTransport speaks the MMDVM framing over an arbitrary net.Conn, so that
+// MMDVM firmware exposed over TCP (shared-modem setups, hardware emulators)
+// can be driven through the same Modem type as a local serial port.
+type NetTransport struct {
+	conn net.Conn
+}
+
+// NewNetTransport wraps conn in a Transport that speaks the MMDVM framing
+// over it.
+func NewNetTransport(conn net.Conn) *NetTransport {
+	return &NetTransport{conn: conn}
+}
+
+// ReadFrame implements Transport.
+func (t *NetTransport) ReadFrame(ctx context.Context) ([]byte, error) {
+	if err := t.conn.SetReadDeadline(deadlineOf(ctx)); err != nil {
+		return nil, err
+	}
+
+	// A deadline alone only covers ctx carrying one; race the read against
+	// ctx.Done() too, so a plain context.WithCancel unblocks an in-flight
+	// conn.Read as soon as it's cancelled.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	frame, err := readFrame(t.conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return frame, err
+}
+
+// WriteFrame implements Transport.
+func (t *NetTransport) WriteFrame(ctx context.Context, frame []byte) error {
+	if err := t.conn.SetWriteDeadline(deadlineOf(ctx)); err != nil {
+		return err
+	}
+
+	// See ReadFrame: race the write against ctx.Done() as well as any
+	// deadline ctx happens to carry.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.conn.SetWriteDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	if _, err := t.conn.Write(encodeFrame(frame)); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Close implements Transport.
+func (t *NetTransport) Close() error {
+	return t.conn.Close()
+}
+
+func deadlineOf(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	return time.Time{}
+}
+
+// readFrame reads a single FrameStart-prefixed packet from r, resynchronising
+// on garbage bytes if necessary, and returns its command byte and payload.
+func readFrame(r io.Reader) ([]byte, error) {
+	head := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		if head[0] == FrameStart {
+			break
+		}
+	}
+
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(r, size); err != nil {
+		return nil, err
+	}
+	if size[0] < 2 {
+		return nil, fmt.Errorf("mmdvm: received invalid packet length %d", size[0])
+	}
+
+	frame := make([]byte, size[0]-2)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// encodeFrame prepends the FrameStart marker and length byte to frame.
+func encodeFrame(frame []byte) []byte {
+	size := uint8(len(frame) + 2)
+	return append([]byte{FrameStart, size}, frame...)
+}
@@ -0,0 +1,206 @@
+package mmdvm
+
+import (
+	"context"
+	"time"
+)
+
+// bufferKind identifies one of the modem's per-mode TX ring buffers.
+type bufferKind uint8
+
+const (
+	bufferDStar bufferKind = iota
+	bufferDMRTS1
+	bufferDMRTS2
+	bufferSystemFusion
+)
+
+// bufferSpaceUnknown marks a buffer whose size hasn't been learned yet from
+// a GetStatus response; enqueuing against it is allowed optimistically
+// since there is nothing to proactively refuse against.
+const bufferSpaceUnknown = -1
+
+// DefaultStatusPollInterval is how often Run refreshes the TX buffer space
+// model via GetStatus, absent an explicit Modem.StatusPollInterval.
+const DefaultStatusPollInterval = 2 * time.Second
+
+// Backoff bounds for retrying a send that was NAKed for lack of buffer space.
+const (
+	minBufferBackoff = 50 * time.Millisecond
+	maxBufferBackoff = 5 * time.Second
+)
+
+// txFrame is one frame queued for transmission on a bufferKind's TX queue.
+type txFrame struct {
+	ctx  context.Context
+	body []byte
+	done chan error
+}
+
+// pollStatus periodically calls Status to keep the TX buffer space model
+// fresh, so EnqueueDMRData and friends reflect reality even when nothing is
+// being sent.
+func (m *Modem) pollStatus(ctx context.Context) {
+	ticker := time.NewTicker(m.StatusPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Status(ctx); err != nil {
+				m.Logger.Printf("status poll failed: %v", err)
+			}
+		}
+	}
+}
+
+// updateBufferSpace refreshes the buffer space model from a GetStatus reply.
+func (m *Modem) updateBufferSpace(s *Status) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.txFree[bufferDStar] = int(s.DStarBufferSize)
+	m.txFree[bufferDMRTS1] = int(s.DMRTS1BufferSize)
+	m.txFree[bufferDMRTS2] = int(s.DMRTS2BufferSize)
+	m.txFree[bufferSystemFusion] = int(s.SystemFusionBufferSize)
+}
+
+// reserve claims one unit of buf's modeled free space, refusing proactively
+// if the model is known and would go negative. A buf whose size hasn't been
+// learned yet (bufferSpaceUnknown) is always allowed through.
+func (m *Modem) reserve(buf bufferKind) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	free := m.txFree[buf]
+	if free == bufferSpaceUnknown {
+		return nil
+	}
+	if free <= 0 {
+		return ErrNotEnoughBufferSpace
+	}
+	m.txFree[buf] = free - 1
+	return nil
+}
+
+// release returns one unit of buf's modeled free space, once the modem has
+// ACKed the frame that consumed it.
+func (m *Modem) release(buf bufferKind) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	if free := m.txFree[buf]; free != bufferSpaceUnknown {
+		m.txFree[buf] = free + 1
+	}
+}
+
+// enqueue reserves space in buf's model, queues body for transmission, and
+// returns once the modem has accepted (or definitively rejected) the frame.
+func (m *Modem) enqueue(ctx context.Context, buf bufferKind, body []byte) error {
+	if err := m.reserve(buf); err != nil {
+		return err
+	}
+
+	req := &txFrame{ctx: ctx, body: body, done: make(chan error, 1)}
+	m.txPending.Add(1)
+
+	select {
+	case m.txQueue[buf] <- req:
+	case <-ctx.Done():
+		m.txPending.Done()
+		m.release(buf)
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runTXQueue serialises frames for a single buffer, retrying with
+// exponential backoff when the modem NAKs a frame for lack of buffer space.
+func (m *Modem) runTXQueue(ctx context.Context, buf bufferKind, queue chan *txFrame) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case req := <-queue:
+			m.sendTXFrame(req, buf)
+		}
+	}
+}
+
+func (m *Modem) sendTXFrame(req *txFrame, buf bufferKind) {
+	defer m.txPending.Done()
+
+	backoff := minBufferBackoff
+	for {
+		err := m.sendAndWaitForACK(req.ctx, req.body)
+		if err != ErrNotEnoughBufferSpace {
+			if err == nil {
+				m.release(buf)
+			}
+			req.done <- err
+			return
+		}
+
+		select {
+		case <-req.ctx.Done():
+			req.done <- req.ctx.Err()
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBufferBackoff {
+			backoff = maxBufferBackoff
+		}
+	}
+}
+
+// EnqueueDStarData queues D-Star data for transmission, returning
+// ErrNotEnoughBufferSpace immediately if the modem's D-Star buffer is known
+// to be full, and otherwise once the frame has been accepted by the modem.
+func (m *Modem) EnqueueDStarData(ctx context.Context, data []byte) error {
+	return m.enqueue(ctx, bufferDStar, append([]byte{DStarData}, data...))
+}
+
+// EnqueueDMRData queues DMR data for transmission on the given time slot
+// (1 or 2), returning ErrNotEnoughBufferSpace immediately if that slot's
+// buffer is known to be full, and otherwise once the frame has been
+// accepted by the modem.
+func (m *Modem) EnqueueDMRData(ctx context.Context, slot uint8, data []byte) error {
+	buf := bufferDMRTS1
+	if slot == 2 {
+		buf = bufferDMRTS2
+	}
+	return m.enqueue(ctx, buf, append([]byte{DMRData}, data...))
+}
+
+// EnqueueSystemFusionData queues System Fusion data for transmission,
+// returning ErrNotEnoughBufferSpace immediately if the modem's System
+// Fusion buffer is known to be full, and otherwise once the frame has been
+// accepted by the modem.
+func (m *Modem) EnqueueSystemFusionData(ctx context.Context, data []byte) error {
+	return m.enqueue(ctx, bufferSystemFusion, append([]byte{SystemFusionData}, data...))
+}
+
+// Drain blocks until every frame handed to an Enqueue* call has been ACKed,
+// NAKed or abandoned, or until ctx is done.
+func (m *Modem) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.txPending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,42 @@
+package mmdvm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pd0mz/go-dv/mmdvm"
+)
+
+func TestEnqueueDMRDataRefusesWhenBufferFull(t *testing.T) {
+	ctx, modem, emu := newTestModem(t)
+
+	emu.Status.DMRTS1BufferSize = 0
+	if _, err := modem.Status(ctx); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+
+	if err := modem.EnqueueDMRData(ctx, 1, []byte{0x01}); !errors.Is(err, mmdvm.ErrNotEnoughBufferSpace) {
+		t.Fatalf("EnqueueDMRData = %v, want ErrNotEnoughBufferSpace", err)
+	}
+}
+
+func TestEnqueueDMRDataAndDrain(t *testing.T) {
+	ctx, modem, emu := newTestModem(t)
+
+	emu.Status.DMRTS1BufferSize = 4
+	if _, err := modem.Status(ctx); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+
+	if err := modem.EnqueueDMRData(ctx, 1, []byte{0x01, 0x02}); err != nil {
+		t.Fatalf("EnqueueDMRData: %v", err)
+	}
+
+	drainCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := modem.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package dv
 
+import "context"
+
 // Modes
 const (
 	ModeDStar uint8 = 1 << iota
@@ -18,8 +20,9 @@ type Modem interface {
 	// Close stops communications with the modem
 	Close() error
 
-	// Run starts communications with the modem
-	Run() error
+	// Run starts communications with the modem, blocking until ctx is
+	// cancelled or an unrecoverable I/O error occurs
+	Run(ctx context.Context) error
 
 	// Version returns the modem version
 	Version() int